@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	lgtmBucketName      = "lgtm"
+	approvalBucketName  = "approvals"
+	holdBucketName      = "holds"
+	eventUUIDBucketName = "event_uuids"
+)
+
+// boltStore is the default, single-instance Store backed by a local bolt
+// database. Writes are additionally serialized by the package-level mutex:
+// bolt already serializes writers internally, but IncrementVote's
+// read-check-clear-write sequence needs to be atomic as a whole.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func voteRootBucket(kind string) string {
+	if kind == voteKindApprove {
+		return approvalBucketName
+	}
+	return lgtmBucketName
+}
+
+func mrKey(project string, mrIID int) []byte {
+	return []byte(fmt.Sprintf("%s#%d", project, mrIID))
+}
+
+func (s *boltStore) IncrementVote(project string, mrIID int, kind, username, commitSHA string, dismissStale bool) ([]VoteRecord, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var voters []VoteRecord
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(voteRootBucket(kind)))
+		if err != nil {
+			return err
+		}
+		mrBucket, err := bucket.CreateBucketIfNotExists(mrKey(project, mrIID))
+		if err != nil {
+			return err
+		}
+
+		if dismissStale && boltStaleVotes(mrBucket, commitSHA) {
+			if err := boltClearBucket(mrBucket); err != nil {
+				return err
+			}
+		}
+
+		record := VoteRecord{Username: username, CommitSHA: commitSHA, Timestamp: time.Now()}
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := mrBucket.Put([]byte(username), recordBytes); err != nil {
+			return err
+		}
+
+		return mrBucket.ForEach(func(k, v []byte) error {
+			var r VoteRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			voters = append(voters, r)
+			return nil
+		})
+	})
+	return voters, err
+}
+
+func (s *boltStore) RemoveVote(project string, mrIID int, kind, username string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(voteRootBucket(kind)))
+		if bucket == nil {
+			return nil
+		}
+		mrBucket := bucket.Bucket(mrKey(project, mrIID))
+		if mrBucket == nil {
+			return nil
+		}
+		return mrBucket.Delete([]byte(username))
+	})
+}
+
+func (s *boltStore) ListVoters(project string, mrIID int, kind string) ([]VoteRecord, error) {
+	var voters []VoteRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(voteRootBucket(kind)))
+		if bucket == nil {
+			return nil
+		}
+		mrBucket := bucket.Bucket(mrKey(project, mrIID))
+		if mrBucket == nil {
+			return nil
+		}
+		return mrBucket.ForEach(func(k, v []byte) error {
+			var r VoteRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			voters = append(voters, r)
+			return nil
+		})
+	})
+	return voters, err
+}
+
+func (s *boltStore) ClearVotes(project string, mrIID int) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, root := range []string{lgtmBucketName, approvalBucketName} {
+			bucket := tx.Bucket([]byte(root))
+			if bucket == nil {
+				continue
+			}
+			if err := bucket.DeleteBucket(mrKey(project, mrIID)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) SetHold(project string, mrIID int, held bool) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(holdBucketName))
+		if err != nil {
+			return err
+		}
+		key := mrKey(project, mrIID)
+		if !held {
+			return bucket.Delete(key)
+		}
+		return bucket.Put(key, []byte("1"))
+	})
+}
+
+func (s *boltStore) GetHold(project string, mrIID int) (bool, error) {
+	held := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(holdBucketName))
+		if bucket == nil {
+			return nil
+		}
+		held = bucket.Get(mrKey(project, mrIID)) != nil
+		return nil
+	})
+	return held, err
+}
+
+func (s *boltStore) RecordEventUUID(eventUUID string) (bool, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	replayed := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(eventUUIDBucketName))
+		if err != nil {
+			return err
+		}
+		if err := pruneExpiredEventUUIDs(bucket); err != nil {
+			return err
+		}
+		if bucket.Get([]byte(eventUUID)) != nil {
+			replayed = true
+			return nil
+		}
+		return bucket.Put([]byte(eventUUID), []byte(time.Now().Format(time.RFC3339)))
+	})
+	return replayed, err
+}
+
+// pruneExpiredEventUUIDs deletes event UUID entries older than voteTTL, so
+// replay-protection state doesn't grow the database file without bound for
+// the life of the process, matching redisStore's TTL-based expiry of the
+// same keys.
+func pruneExpiredEventUUIDs(bucket *bolt.Bucket) error {
+	cutoff := time.Now().Add(-voteTTL)
+	var expired [][]byte
+	if err := bucket.ForEach(func(k, v []byte) error {
+		recorded, err := time.Parse(time.RFC3339, string(v))
+		if err != nil || recorded.Before(cutoff) {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltStaleVotes(mrBucket *bolt.Bucket, headSHA string) bool {
+	stale := false
+	mrBucket.ForEach(func(k, v []byte) error {
+		var r VoteRecord
+		if err := json.Unmarshal(v, &r); err != nil {
+			return nil
+		}
+		if r.CommitSHA != headSHA {
+			stale = true
+		}
+		return nil
+	})
+	return stale
+}
+
+func boltClearBucket(mrBucket *bolt.Bucket) error {
+	var keys [][]byte
+	mrBucket.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+	for _, k := range keys {
+		if err := mrBucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
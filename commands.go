@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	cmdLGTM    = "/lgtm"
+	cmdHold    = "/hold"
+	cmdUnhold  = "/unhold"
+	cmdApprove = "/approve"
+	cmdRetest  = "/retest"
+
+	cmdArgCancel = "cancel"
+)
+
+var validApproveCount = flag.Int("approve_count", 0, "required /approve vote count; 0 disables the /approve quorum check")
+
+// parseCommands extracts Prow-style slash commands from a comment body, one
+// per line. A bare note matching --lgtm_note (case-insensitively) is treated
+// as "/lgtm" for backwards compatibility with the original keyword-only bot.
+func parseCommands(note string) []string {
+	var commands []string
+	for _, line := range strings.Split(note, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "/") {
+			commands = append(commands, line)
+		}
+	}
+	if len(commands) == 0 && strings.ToUpper(strings.TrimSpace(note)) == *lgtmNote {
+		commands = append(commands, cmdLGTM)
+	}
+	return commands
+}
+
+// dispatchCommands runs every slash command found in comment's note body and
+// reports whether the MR should be considered for merge as a result.
+func dispatchCommands(comment Comment) (mergeable bool, err error) {
+	project := comment.Project.PathWithNamespace
+
+	if comment.MergeRequest.State == "closed" || comment.MergeRequest.State == "merged" {
+		if err := store.ClearVotes(project, comment.MergeRequest.Iid); err != nil {
+			return false, err
+		}
+		if err := store.SetHold(project, comment.MergeRequest.Iid, false); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	// Re-derive quorum from persisted store state up front, so a comment
+	// that only touches one vote kind (or none at all, e.g. a bare /hold)
+	// doesn't fall back to a default that could let the MR merge while the
+	// other kind is still below quorum.
+	lgtmQuorum, err := lgtmQuorumMet(comment)
+	if err != nil {
+		return false, err
+	}
+	approveQuorum, err := approveQuorumMet(comment)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range parseCommands(comment.ObjectAttributes.Note) {
+		fields := strings.Fields(line)
+		cmd := strings.ToLower(fields[0])
+		arg := ""
+		if len(fields) > 1 {
+			arg = strings.ToLower(fields[1])
+		}
+
+		switch cmd {
+		case cmdLGTM:
+			if !checkReviewers(comment) {
+				continue
+			}
+			if arg == cmdArgCancel {
+				if err := store.RemoveVote(project, comment.MergeRequest.Iid, voteKindLGTM, comment.User.Username); err != nil {
+					return false, err
+				}
+				lgtmQuorum, err = lgtmQuorumMet(comment)
+				if err != nil {
+					return false, err
+				}
+				continue
+			}
+			lgtmQuorum, err = checkLGTMVotes(comment)
+			if err != nil {
+				return false, err
+			}
+
+		case cmdHold:
+			if err := store.SetHold(project, comment.MergeRequest.Iid, true); err != nil {
+				return false, err
+			}
+			logrus.WithField("MR", comment.MergeRequest.Iid).Info("hold set")
+
+		case cmdUnhold:
+			if err := store.SetHold(project, comment.MergeRequest.Iid, false); err != nil {
+				return false, err
+			}
+			logrus.WithField("MR", comment.MergeRequest.Iid).Info("hold cleared")
+
+		case cmdApprove:
+			if !checkApprovers(comment) {
+				continue
+			}
+			approveQuorum, err = checkApproveVotes(comment)
+			if err != nil {
+				return false, err
+			}
+
+		case cmdRetest:
+			retestMergeRequest(comment)
+
+		default:
+			// unrecognised command, ignore
+		}
+	}
+
+	held, err := store.GetHold(project, comment.MergeRequest.Iid)
+	if err != nil {
+		return false, err
+	}
+	if held {
+		logrus.WithField("MR", comment.MergeRequest.Iid).Info("MR is held, not considering for merge")
+		return false, nil
+	}
+
+	return lgtmQuorum && approveQuorum, nil
+}
+
+// checkApprovers reports whether comment's author is allowed to /approve.
+// An empty approvers list means the command is disabled.
+func checkApprovers(comment Comment) bool {
+	approvers := resolveProjectConfig(comment.Project.PathWithNamespace).Approvers
+	if len(approvers) == 0 {
+		logrus.Warn("/approve used but no approvers are configured")
+		return false
+	}
+	for _, approver := range approvers {
+		if approver == comment.User.Username {
+			return true
+		}
+	}
+	logrus.Warn("User ", comment.User.Username, " is not allowed to /approve")
+	return false
+}
+
+// retestMergeRequest triggers a pipeline retry for the merge request's head
+// pipeline via GitLab's pipelines API, in response to a "/retest" command.
+func retestMergeRequest(comment Comment) {
+	mr, _, err := glClient.MergeRequests.GetMergeRequest(comment.ProjectID, comment.MergeRequest.Iid, nil)
+	if err != nil {
+		logrus.WithError(err).Errorln("fetch merge request for /retest failed")
+		return
+	}
+	if mr.HeadPipeline == nil {
+		logrus.WithField("MR", comment.MergeRequest.Iid).Warn("/retest: no pipeline to retry")
+		return
+	}
+	if _, _, err := glClient.Pipelines.RetryPipelineBuild(comment.ProjectID, mr.HeadPipeline.ID); err != nil {
+		logrus.WithError(err).Errorln("retry pipeline failed")
+	}
+}
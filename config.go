@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var configPath = flag.String("config_path", "reviewers.yaml", "path to the reviewers/projects configuration file")
+
+// BranchRule overrides the LGTM quorum for merge requests targeting a
+// specific branch, e.g. "main" needs 2 LGTMs but "develop" only 1.
+type BranchRule struct {
+	LGTMCount int `yaml:"lgtm_count"`
+}
+
+// ProjectConfig holds every per-project setting this bot understands. The
+// Default entry of MultiConf is a ProjectConfig too, so a project simply
+// inherits it wholesale when absent from Projects.
+type ProjectConfig struct {
+	Reviewers           []string              `yaml:"reviewers"`
+	Approvers           []string              `yaml:"approvers"`
+	LGTMCount           int                   `yaml:"lgtm_count"`
+	ApproveCount        int                   `yaml:"approve_count"`
+	RequiredLabels      []string              `yaml:"required_labels"`
+	BlockedLabels       []string              `yaml:"blocked_labels"`
+	BranchRules         map[string]BranchRule `yaml:"branch_rules"`
+	MergeOptions        MergeOptions          `yaml:"merge_options"`
+	PreMergeChecks      PreMergeChecks        `yaml:"pre_merge_checks"`
+	DismissStaleReviews bool                  `yaml:"dismiss_stale_reviews"`
+	WebhookSecret       string                `yaml:"webhook_secret"`
+	ReplayProtection    bool                  `yaml:"replay_protection"`
+}
+
+// MultiConf is the versioned, multi-project configuration file format.
+// Default applies to any project not listed in Projects.
+type MultiConf struct {
+	Version  int                      `yaml:"version"`
+	Default  ProjectConfig            `yaml:"default"`
+	Projects map[string]ProjectConfig `yaml:"projects"`
+}
+
+var (
+	configMu sync.RWMutex
+	config   MultiConf
+)
+
+// loadConfig reads and validates the configuration file, replacing the
+// in-memory config on success. A missing file is not an error: the bot runs
+// on the Default zero-value (anyone may /lgtm; /approve is disabled since no
+// approvers are listed).
+func loadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logrus.WithField("path", path).Warn("no config file found, running with defaults")
+			return nil
+		}
+		return err
+	}
+
+	var parsed MultiConf
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := validateConfig(&parsed); err != nil {
+		return fmt.Errorf("validate %s: %w", path, err)
+	}
+
+	configMu.Lock()
+	config = parsed
+	configMu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"path":     path,
+		"projects": len(parsed.Projects),
+	}).Info("config loaded")
+	return nil
+}
+
+func validateConfig(c *MultiConf) error {
+	if c.Default.LGTMCount < 0 {
+		return fmt.Errorf("default.lgtm_count must not be negative")
+	}
+	for name, p := range c.Projects {
+		if p.LGTMCount < 0 {
+			return fmt.Errorf("project %q: lgtm_count must not be negative", name)
+		}
+		for branch, rule := range p.BranchRules {
+			if rule.LGTMCount < 1 {
+				return fmt.Errorf("project %q: branch_rules[%q].lgtm_count must be at least 1", name, branch)
+			}
+		}
+	}
+	return nil
+}
+
+// watchConfig reloads the configuration file whenever it changes on disk, so
+// edits take effect without restarting the process.
+//
+// It watches the containing directory rather than the file itself: editors
+// and deploy tools that save via temp-file-plus-rename (vim, `kubectl
+// apply`, ConfigMap symlink swaps) replace the file's inode, which would
+// silently kill a watch on the file path after the very first edit.
+func watchConfig(path string) {
+	dir := filepath.Dir(path)
+	name := filepath.Base(path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.WithError(err).Error("start config watcher failed")
+		return
+	}
+	if err := watcher.Add(dir); err != nil {
+		logrus.WithError(err).Warn("watch config directory failed, edits will require a restart")
+		return
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != name {
+				continue
+			}
+			if event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+				// The directory watch survives a rename/remove of the file
+				// itself, but re-Add defensively in case the watch was
+				// dropped underneath us (e.g. the directory was recreated).
+				if err := watcher.Add(dir); err != nil {
+					logrus.WithError(err).Warn("re-watch config directory failed, edits will require a restart")
+				}
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := loadConfig(path); err != nil {
+				logrus.WithError(err).Error("reload config failed, keeping previous config")
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithError(err).Warn("config watcher error")
+		}
+	}
+}
+
+// resolveProjectConfig returns projectPath's configuration, falling back to
+// the global Default when the project isn't listed.
+func resolveProjectConfig(projectPath string) ProjectConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	if p, ok := config.Projects[projectPath]; ok {
+		return p
+	}
+	return config.Default
+}
+
+// lgtmCountFor resolves the effective LGTM quorum for a merge request:
+// a branch_rules entry wins, then the project/default lgtm_count, then the
+// --lgtm_count flag.
+func lgtmCountFor(projectPath, targetBranch string) int {
+	pc := resolveProjectConfig(projectPath)
+	if rule, ok := pc.BranchRules[targetBranch]; ok {
+		return rule.LGTMCount
+	}
+	if pc.LGTMCount > 0 {
+		return pc.LGTMCount
+	}
+	return *validLGTMCount
+}
+
+// approveCountFor resolves the effective /approve quorum for a project: the
+// project/default approve_count, then the --approve_count flag. 0 means the
+// /approve quorum check is disabled.
+func approveCountFor(projectPath string) int {
+	pc := resolveProjectConfig(projectPath)
+	if pc.ApproveCount > 0 {
+		return pc.ApproveCount
+	}
+	return *validApproveCount
+}
+
+// configHandler exposes the effective configuration for inspection. Webhook
+// secrets are redacted since this endpoint has no auth of its own.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	configMu.RLock()
+	redacted := config
+	redacted.Default.WebhookSecret = redactSecret(redacted.Default.WebhookSecret)
+	redacted.Projects = make(map[string]ProjectConfig, len(config.Projects))
+	for name, p := range config.Projects {
+		p.WebhookSecret = redactSecret(p.WebhookSecret)
+		redacted.Projects[name] = p
+	}
+	configMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redacted)
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+var (
+	mergeCommitMessage        = flag.String("merge_commit_message", "", "custom merge commit message (overridable per-project in reviewers.yaml)")
+	squash                    = flag.Bool("squash", false, "squash commits on merge")
+	squashCommitMessage       = flag.String("squash_commit_message", "", "custom squash commit message")
+	mergeWhenPipelineSucceeds = flag.Bool("merge_when_pipeline_succeeds", false, "merge as soon as the pipeline on the head sha succeeds")
+)
+
+// glClient is the shared GitLab API client used for all merge/API interactions.
+var glClient *gitlab.Client
+
+// MergeOptions holds the merge-request accept options. The zero value maps
+// to the global CLI flags; per-project entries in reviewers.yaml override it.
+type MergeOptions struct {
+	MergeCommitMessage        string `yaml:"merge_commit_message"`
+	Squash                    bool   `yaml:"squash"`
+	SquashCommitMessage       string `yaml:"squash_commit_message"`
+	MergeWhenPipelineSucceeds bool   `yaml:"merge_when_pipeline_succeeds"`
+}
+
+func initGitlabClient() error {
+	var err error
+	glClient, err = gitlab.NewClient(*privateToken, gitlab.WithBaseURL(*gitlabURL))
+	return err
+}
+
+// resolveMergeOptions returns the effective merge options for a project: its
+// merge_options block in the config file, falling back to the CLI flags
+// when that project (or the default) left merge_options unset.
+func resolveMergeOptions(projectPath string) MergeOptions {
+	if opts := resolveProjectConfig(projectPath).MergeOptions; opts != (MergeOptions{}) {
+		return opts
+	}
+	return MergeOptions{
+		MergeCommitMessage:        *mergeCommitMessage,
+		Squash:                    *squash,
+		SquashCommitMessage:       *squashCommitMessage,
+		MergeWhenPipelineSucceeds: *mergeWhenPipelineSucceeds,
+	}
+}
+
+// acceptMergeRequest accepts a merge request via the go-gitlab client,
+// pinning the merge to headSHA so a push racing the merge is rejected by
+// GitLab instead of silently merging new commits. It reports whether the
+// merge actually went through, so callers don't treat a rejected accept
+// (conflicts, already merged, a racing push) as a successful merge.
+func acceptMergeRequest(projectID int, mergeRequestIID int, projectPath string, headSHA string, shouldRemoveSourceBranch bool) bool {
+	opts := resolveMergeOptions(projectPath)
+
+	acceptOpts := &gitlab.AcceptMergeRequestOptions{
+		ShouldRemoveSourceBranch:  gitlab.Bool(shouldRemoveSourceBranch),
+		Squash:                    gitlab.Bool(opts.Squash),
+		MergeWhenPipelineSucceeds: gitlab.Bool(opts.MergeWhenPipelineSucceeds),
+	}
+	if opts.MergeCommitMessage != "" {
+		acceptOpts.MergeCommitMessage = gitlab.String(opts.MergeCommitMessage)
+	}
+	if opts.SquashCommitMessage != "" {
+		acceptOpts.SquashCommitMessage = gitlab.String(opts.SquashCommitMessage)
+	}
+	if headSHA != "" {
+		acceptOpts.SHA = gitlab.String(headSHA)
+	}
+
+	_, resp, err := glClient.MergeRequests.AcceptMergeRequest(projectID, mergeRequestIID, acceptOpts)
+	if err != nil {
+		if resp == nil {
+			logrus.WithError(err).Errorln("accept merge request failed")
+			return false
+		}
+		switch resp.StatusCode {
+		case 405:
+			logrus.Warnln("it has some conflicts and can not be merged")
+		case 406:
+			logrus.Warnln("merge request is already merged or closed")
+		case 409:
+			logrus.Warnln("head sha changed since the LGTM was counted, rebase in progress or a new push raced the merge")
+		default:
+			logrus.WithFields(logrus.Fields{
+				"http_code": resp.StatusCode,
+				"error":     err.Error(),
+			}).Errorln("accept merge failed")
+		}
+		return false
+	}
+
+	logrus.Info("accept merge request successfully")
+	return true
+}
@@ -1,23 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/boltdb/bolt"
-	yaml "gopkg.in/yaml.v2"
 )
 
 var (
@@ -25,9 +20,10 @@ var (
 	ErrInvalidRequest = errors.New("invalid request body")
 	// ErrInvalidContentType ...
 	ErrInvalidContentType = errors.New("invalid content type")
+	// ErrInvalidWebhookToken ...
+	ErrInvalidWebhookToken = errors.New("invalid X-Gitlab-Token header")
 	// RespOK ...
 	RespOK       = []byte("OK")
-	db           *bolt.DB
 	buildVersion string
 )
 
@@ -40,7 +36,6 @@ const (
 	NoteLGTM = "LGTM"
 	// StatusCanbeMerged ...
 	StatusCanbeMerged = "can_be_merged"
-	bucketName        = "lgtm"
 )
 
 var (
@@ -53,33 +48,7 @@ var (
 	dbPath         = flag.String("db_path", "lgtm.data", "bolt db data")
 )
 
-var (
-	mutex sync.RWMutex
-	// map[merge_request_id][count]
-	lgtmCount = make(map[int]int)
-
-	glURL *url.URL
-)
-
-// Conf configuration of allowed reviewers
-type Conf struct {
-	Reviewers []string `yaml:"reviewers"`
-}
-
-var reviewers Conf
-
-// Get list of reviewers that has allowed to accept a merge request
-func (c *Conf) getReviewers() *Conf {
-	yamlFile, err := ioutil.ReadFile("reviewers.yaml")
-	if err != nil {
-		return nil
-	}
-	err = yaml.Unmarshal(yamlFile, c)
-	if err != nil {
-		logrus.Fatalf("Unmarshal: %v", err)
-	}
-	return c
-}
+var mutex sync.RWMutex
 
 func formatLogLevel(level string) logrus.Level {
 	l, err := logrus.ParseLevel(string(level))
@@ -92,17 +61,18 @@ func formatLogLevel(level string) logrus.Level {
 }
 
 func init() {
-	flag.Parse()
 	logrus.SetOutput(os.Stderr)
 	logrus.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp:   true,
 		TimestampFormat: "2006-01-02 15:04:05",
 	})
-	logrus.SetLevel(formatLogLevel(*logLevel))
-	logrus.WithField("buildVersion", buildVersion).Info("build info")
 }
 
 func main() {
+	flag.Parse()
+	logrus.SetLevel(formatLogLevel(*logLevel))
+	logrus.WithField("buildVersion", buildVersion).Info("build info")
+
 	if *privateToken == "" {
 		logrus.Fatal("private token is required")
 	}
@@ -111,14 +81,25 @@ func main() {
 	}
 
 	var err error
-	db, err = bolt.Open(*dbPath, 0600, nil)
+	store, err = newStore()
 	if err != nil {
-		logrus.WithError(err).Fatal("open local db failed")
+		logrus.WithError(err).Fatal("init store failed")
+	}
+	if closer, ok := store.(interface{ Close() error }); ok {
+		defer closer.Close()
+	}
+	if err := initGitlabClient(); err != nil {
+		logrus.WithError(err).Fatal("init gitlab client failed")
+	}
+
+	if err := loadConfig(*configPath); err != nil {
+		logrus.WithError(err).Fatal("load config failed")
 	}
-	defer db.Close()
-	parseURL(*gitlabURL)
+	go watchConfig(*configPath)
 
 	http.HandleFunc("/gitlab/hook", LGTMHandler)
+	http.HandleFunc("/gitlab/status", statusHandler)
+	http.HandleFunc("/config", configHandler)
 	go func() {
 		logrus.Infof("Webhook server listen on 0.0.0.0:%d", *port)
 		http.ListenAndServe(":"+strconv.Itoa(*port), nil)
@@ -127,26 +108,27 @@ func main() {
 	<-(chan struct{})(nil)
 }
 
-func parseURL(urlStr string) {
-	var err error
-	glURL, err = url.Parse(urlStr)
-	if err != nil {
-		panic(err.Error())
-	}
-}
-
 // LGTMHandler ...
 func LGTMHandler(w http.ResponseWriter, r *http.Request) {
+	event := r.Header.Get(headerGitlabEvent)
+	eventUUID := r.Header.Get(headerGitlabEventUUID)
 	logrus.WithFields(logrus.Fields{
 		"method":      r.Method,
 		"remote_addr": r.RemoteAddr,
+		"event":       event,
+		"event_uuid":  eventUUID,
 	}).Infoln("access")
 	var errRet error
+	var unauthorized bool
 	defer func() {
 		if errRet != nil {
 			errMsg := fmt.Sprintf("error occurs:%s", errRet.Error())
 			logrus.WithError(errRet).Errorln("error response")
-			w.WriteHeader(http.StatusBadRequest)
+			if unauthorized {
+				w.WriteHeader(http.StatusUnauthorized)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
 			fmt.Fprintf(w, errMsg)
 			return
 		}
@@ -166,8 +148,36 @@ func LGTMHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errRet = err
+		return
+	}
+
+	projectPath := peekProjectPath(body)
+	if !verifyWebhookToken(r, projectPath) {
+		errRet = ErrInvalidWebhookToken
+		unauthorized = true
+		return
+	}
+
+	replayed, err := checkReplay(projectPath, eventUUID)
+	if err != nil {
+		errRet = err
+		return
+	}
+	if replayed {
+		logrus.WithField("event_uuid", eventUUID).Warn("ignoring replayed webhook delivery")
+		return
+	}
+
+	if event != "" && event != NoteHookEvent {
+		logrus.WithField("event", event).Info("ignoring unsupported event kind")
+		return
+	}
+
 	var comment Comment
-	if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
+	if err := json.Unmarshal(body, &comment); err != nil {
 		errRet = err
 		return
 	}
@@ -181,42 +191,47 @@ func checkLgtm(comment Comment) error {
 		return nil
 	}
 
-	if !checkReviewers(comment) {
-		// unmatched, do nothing
-		return nil
-	}
-
 	if comment.ObjectAttributes.NoteableType != NoteableTypeMergeRequest {
 		// unmatched, do nothing
 		return nil
 	}
 
-	if strings.ToUpper(comment.ObjectAttributes.Note) != *lgtmNote {
-		// unmatched, do nothing
-		return nil
-	}
-
-	// TODO: Check the comments LGTM two people are different people
-	var (
-		canbeMerged bool
-		err         error
-	)
 	logrus.WithFields(logrus.Fields{
 		"user": comment.User.Username,
 		"note": comment.ObjectAttributes.Note,
 		"MR":   comment.MergeRequest.Iid,
 	}).Info("comment")
 
-	canbeMerged, err = checkLGTMCount(comment)
-
+	canbeMerged, err := dispatchCommands(comment)
 	if err != nil {
-		logrus.WithError(err).Errorln("check LGTM count failed")
+		logrus.WithError(err).Errorln("dispatch commands failed")
 		return nil
 	}
 
 	if canbeMerged && comment.MergeRequest.MergeStatus == StatusCanbeMerged {
+		failures, err := runPreMergeChecks(comment)
+		if err != nil {
+			logrus.WithError(err).Errorln("run pre-merge checks failed")
+			return nil
+		}
+		if len(failures) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"MR":       comment.MergeRequest.Iid,
+				"failures": failures,
+			}).Info("The MR can not be merged yet.")
+			commentFailedChecks(comment, failures)
+			return nil
+		}
+
 		logrus.WithField("MR", comment.MergeRequest.Iid).Info("The MR can be merged.")
-		acceptMergeRequest(comment.ProjectID, comment.MergeRequest.Iid, comment.MergeRequest.MergeParams.ForceRemoveSourceBranch)
+		removeSourceBranch := comment.MergeRequest.MergeParams.ForceRemoveSourceBranch == "true"
+		merged := acceptMergeRequest(comment.ProjectID, comment.MergeRequest.Iid, comment.Project.PathWithNamespace, comment.MergeRequest.LastCommit.ID, removeSourceBranch)
+		if !merged {
+			return nil
+		}
+		if err := store.ClearVotes(comment.Project.PathWithNamespace, comment.MergeRequest.Iid); err != nil {
+			logrus.WithError(err).Warnln("clear votes after merge failed")
+		}
 	} else {
 		logrus.WithFields(logrus.Fields{
 			"MR":          comment.MergeRequest.Iid,
@@ -227,15 +242,18 @@ func checkLgtm(comment Comment) error {
 	return nil
 }
 
-// Check if users that send LGTM message has permission to do it.
+// checkReviewers reports whether comment's author is allowed to /lgtm.
+// It's applied per-command in dispatchCommands rather than as a blanket
+// gate, since /approve, /hold, /unhold, and /retest have their own (or no)
+// role restriction.
 func checkReviewers(comment Comment) bool {
-	// If not exist a reviewers list or is empty, do nothing
-	if reviewers.getReviewers() == nil || len(reviewers.Reviewers) == 0 {
+	pc := resolveProjectConfig(comment.Project.PathWithNamespace)
+	// If no reviewers list is configured for this project, allow anyone
+	if len(pc.Reviewers) == 0 {
 		return true
 	}
-	// Check if the user is a reviewer
-	for i := range reviewers.Reviewers {
-		if reviewers.Reviewers[i] == comment.User.Username {
+	for _, reviewer := range pc.Reviewers {
+		if reviewer == comment.User.Username {
 			return true
 		}
 	}
@@ -243,95 +261,11 @@ func checkReviewers(comment Comment) bool {
 	return false
 }
 
-func checkLGTMCount(comment Comment) (bool, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	tx, err := db.Begin(true)
-	if err != nil {
-		return false, err
-	}
-	bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-	if err != nil {
-		return false, err
-	}
-	count := 0
-	countKey := []byte(strconv.Itoa(comment.MergeRequest.Iid))
-	countByte := bucket.Get(countKey)
-	if len(countByte) > 0 {
-		count, err = strconv.Atoi(string(countByte))
-		if err != nil {
-			logrus.WithField("value", string(countByte)).Warnln("wrong count")
-			count = 0
-			err = nil
-		}
-	}
-
-	count++
-
-	if err := bucket.Put(countKey, []byte(strconv.Itoa(count))); err != nil {
-		return false, err
-	}
-	checkStatus := count%(*validLGTMCount) == 0
-
-	if err := tx.Commit(); err != nil {
-		return checkStatus, err
-	}
-	logrus.WithFields(logrus.Fields{
-		"count": count,
-		"MR":    comment.MergeRequest.Iid,
-	}).Info("MR count")
-	return checkStatus, nil
-}
-
-func acceptMergeRequest(projectID int, mergeRequestIID int, shouldRemoveSourceBranch string) {
-	params := map[string]string{
-		"should_remove_source_branch": shouldRemoveSourceBranch,
-	}
-	bodyBytes, err := json.Marshal(params)
-	if err != nil {
-		logrus.WithError(err).Errorln("json marshal failed")
-		return
-	}
-
-	glURL.Path = glURL.Path + fmt.Sprintf("/api/v4/projects/%d/merge_requests/%d/merge", projectID, mergeRequestIID)
-	req, err := http.NewRequest("PUT", glURL.String(), bytes.NewReader(bodyBytes))
-	if err != nil {
-		logrus.WithError(err).Errorln("http NewRequest failed")
-		return
-	}
-	req.Header.Set("Conntent-Type", "application/json")
-	// authenticate
-	req.Header.Set("PRIVATE-TOKEN", *privateToken) // my private token
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		logrus.WithError(err).Errorln("execute request failed")
-		return
-	}
-
-	switch resp.StatusCode {
-	// 200
-	case http.StatusOK:
-		logrus.Info("accept merge request successfully")
-	// 405
-	case http.StatusMethodNotAllowed:
-		logrus.Warnln("it has some conflicts and can not be merged")
-	// 406
-	case http.StatusNotAcceptable:
-		logrus.Warnln("merge request is already merged or closed")
-	default:
-		logrus.WithFields(logrus.Fields{
-			"http_code":   resp.StatusCode,
-			"http_status": resp.Status,
-		}).Errorln("accept merge failed")
-	}
-}
-
 // Comment represents gitlab comment events
 type Comment struct {
 	ObjectKind string `json:"object_kind"`
 	User       struct {
+		ID        int    `json:"id"`
 		Name      string `json:"name"`
 		Username  string `json:"username"`
 		AvatarURL string `json:"avatar_url"`
@@ -456,5 +390,3 @@ type Comment struct {
 		WorkInProgress bool `json:"work_in_progress"`
 	} `json:"merge_request"`
 }
-
-// Follow-up support redis. HINCR lgtm merge_id 1
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// PreMergeChecks lists the safety checks to run before accepting a merge
+// request. Each check is individually toggleable in the config file; an
+// unset (zero value) entry runs no checks, preserving the old behaviour.
+type PreMergeChecks struct {
+	RequirePipelineSuccess     bool     `yaml:"require_pipeline_success"`
+	AllowedPipelineStatuses    []string `yaml:"allowed_pipeline_statuses"`
+	RequireNotWorkInProgress   bool     `yaml:"require_not_work_in_progress"`
+	RequireDiscussionsResolved bool     `yaml:"require_discussions_resolved"`
+	RequireApprovals           bool     `yaml:"require_approvals"`
+}
+
+// runPreMergeChecks queries GitLab for the current state of the merge
+// request and evaluates every enabled check, returning the reasons for any
+// that failed. An empty slice means the MR is safe to merge.
+func runPreMergeChecks(comment Comment) ([]string, error) {
+	pc := resolveProjectConfig(comment.Project.PathWithNamespace)
+	checks := pc.PreMergeChecks
+	var failures []string
+
+	mr, _, err := glClient.MergeRequests.GetMergeRequest(comment.ProjectID, comment.MergeRequest.Iid, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetch merge request: %w", err)
+	}
+
+	if checks.RequireNotWorkInProgress && mr.WorkInProgress {
+		failures = append(failures, "merge request is still marked as WIP/Draft")
+	}
+
+	if checks.RequireDiscussionsResolved && !mr.BlockingDiscussionsResolved {
+		failures = append(failures, "not all blocking discussions are resolved")
+	}
+
+	if checks.RequirePipelineSuccess {
+		allowed := checks.AllowedPipelineStatuses
+		if len(allowed) == 0 {
+			allowed = []string{"success"}
+		}
+		if mr.HeadPipeline == nil {
+			failures = append(failures, "no pipeline found for the head sha")
+		} else if !statusAllowed(mr.HeadPipeline.Status, allowed) {
+			failures = append(failures, fmt.Sprintf("pipeline status %q is not in the allowed set %v", mr.HeadPipeline.Status, allowed))
+		}
+	}
+
+	if checks.RequireApprovals {
+		approvals, _, err := glClient.MergeRequestApprovals.GetConfiguration(comment.ProjectID, comment.MergeRequest.Iid)
+		if err != nil {
+			return nil, fmt.Errorf("fetch approvals: %w", err)
+		}
+		if !approvals.Approved {
+			failures = append(failures, fmt.Sprintf("approvals not met: %d of %d required", len(approvals.ApprovedBy), approvals.ApprovalsRequired))
+		}
+	}
+
+	for _, required := range pc.RequiredLabels {
+		if !hasLabel(mr.Labels, required) {
+			failures = append(failures, fmt.Sprintf("missing required label %q", required))
+		}
+	}
+	for _, blocked := range pc.BlockedLabels {
+		if hasLabel(mr.Labels, blocked) {
+			failures = append(failures, fmt.Sprintf("has blocked label %q", blocked))
+		}
+	}
+
+	return failures, nil
+}
+
+func hasLabel(labels gitlab.Labels, name string) bool {
+	for _, l := range labels {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+func statusAllowed(status string, allowed []string) bool {
+	for _, s := range allowed {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// commentFailedChecks posts the pre-merge check failures back to the MR so
+// the author/reviewers know why the LGTM quorum didn't trigger a merge.
+func commentFailedChecks(comment Comment, failures []string) {
+	body := "LGTM quorum reached, but the merge was blocked by pre-merge checks:\n"
+	for _, f := range failures {
+		body += fmt.Sprintf("- %s\n", f)
+	}
+
+	opt := &gitlab.CreateMergeRequestNoteOptions{Body: &body}
+	if _, _, err := glClient.Notes.CreateMergeRequestNote(comment.ProjectID, comment.MergeRequest.Iid, opt); err != nil {
+		logrus.WithError(err).Errorln("post pre-merge check comment failed")
+	}
+}
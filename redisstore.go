@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// voteTTL expires a merge request's votes/hold state automatically once it's
+// been inactive this long, so closed MRs don't leak keys forever.
+const voteTTL = 30 * 24 * time.Hour
+
+// incrementVoteScript folds the stale-vote dismissal check, the hash update,
+// and the count read into a single atomic Lua script, so concurrent
+// replicas voting on the same MR never race each other between the
+// staleness check and the vote it guards.
+var incrementVoteScript = redis.NewScript(`
+	if ARGV[4] == "1" then
+		local existing = redis.call('HGETALL', KEYS[1])
+		for i = 2, #existing, 2 do
+			if existing[i] ~= ARGV[2] then
+				redis.call('DEL', KEYS[1])
+				break
+			end
+		end
+	end
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+	return redis.call('HGETALL', KEYS[1])
+`)
+
+// redisStore lets several lgtm-gitlab replicas behind a load balancer share
+// vote/hold state, selected with --store=redis --redis_addr=....
+type redisStore struct {
+	client *redis.Client
+}
+
+func newRedisStore(addr string) (*redisStore, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping().Err(); err != nil {
+		return nil, err
+	}
+	return &redisStore{client: client}, nil
+}
+
+func voteHashKey(kind, project string, mrIID int) string {
+	return fmt.Sprintf("%s:%s:%d", kind, project, mrIID)
+}
+
+func holdKey(project string, mrIID int) string {
+	return fmt.Sprintf("hold:%s:%d", project, mrIID)
+}
+
+func eventUUIDKey(eventUUID string) string {
+	return fmt.Sprintf("event:%s", eventUUID)
+}
+
+func (s *redisStore) IncrementVote(project string, mrIID int, kind, username, commitSHA string, dismissStale bool) ([]VoteRecord, error) {
+	key := voteHashKey(kind, project, mrIID)
+
+	dismissArg := "0"
+	if dismissStale {
+		dismissArg = "1"
+	}
+
+	raw, err := incrementVoteScript.Run(s.client, []string{key}, username, commitSHA, int(voteTTL.Seconds()), dismissArg).Result()
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected HGETALL reply type %T", raw)
+	}
+
+	voters := make([]VoteRecord, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		voters = append(voters, VoteRecord{
+			Username:  fmt.Sprint(fields[i]),
+			CommitSHA: fmt.Sprint(fields[i+1]),
+		})
+	}
+	return voters, nil
+}
+
+func (s *redisStore) RemoveVote(project string, mrIID int, kind, username string) error {
+	return s.client.HDel(voteHashKey(kind, project, mrIID), username).Err()
+}
+
+func (s *redisStore) ListVoters(project string, mrIID int, kind string) ([]VoteRecord, error) {
+	result, err := s.client.HGetAll(voteHashKey(kind, project, mrIID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	voters := make([]VoteRecord, 0, len(result))
+	for username, sha := range result {
+		voters = append(voters, VoteRecord{Username: username, CommitSHA: sha})
+	}
+	return voters, nil
+}
+
+func (s *redisStore) ClearVotes(project string, mrIID int) error {
+	return s.client.Del(voteHashKey(voteKindLGTM, project, mrIID), voteHashKey(voteKindApprove, project, mrIID)).Err()
+}
+
+func (s *redisStore) SetHold(project string, mrIID int, held bool) error {
+	if !held {
+		return s.client.Del(holdKey(project, mrIID)).Err()
+	}
+	return s.client.Set(holdKey(project, mrIID), "1", voteTTL).Err()
+}
+
+func (s *redisStore) GetHold(project string, mrIID int) (bool, error) {
+	n, err := s.client.Exists(holdKey(project, mrIID)).Result()
+	return n > 0, err
+}
+
+func (s *redisStore) RecordEventUUID(eventUUID string) (bool, error) {
+	set, err := s.client.SetNX(eventUUIDKey(eventUUID), "1", voteTTL).Result()
+	if err != nil {
+		return false, err
+	}
+	return !set, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+const (
+	voteKindLGTM    = "lgtm"
+	voteKindApprove = "approve"
+)
+
+var (
+	errStoreRedisAddrRequired = errors.New("redis_addr is required when --store=redis")
+	errStoreUnknownBackend    = errors.New("unknown --store backend, want \"bolt\" or \"redis\"")
+)
+
+var (
+	storeBackend = flag.String("store", "bolt", "storage backend: bolt or redis")
+	redisAddr    = flag.String("redis_addr", "", "redis address, e.g. localhost:6379 (required when --store=redis)")
+)
+
+// Store is the persistence backend for votes, holds, and webhook replay
+// protection. It's implemented by boltStore (a single local file, the
+// default) and redisStore (shared state for a load-balanced fleet of
+// replicas, selected with --store=redis).
+type Store interface {
+	// IncrementVote records username's vote of the given kind for a merge
+	// request and returns the resulting voter set. When dismissStale is set
+	// and the stored votes were cast against a different commit sha than
+	// commitSHA, the prior votes are cleared first so a new push starts the
+	// quorum over.
+	IncrementVote(project string, mrIID int, kind, username, commitSHA string, dismissStale bool) ([]VoteRecord, error)
+	// RemoveVote removes username's vote of the given kind, e.g. on "/lgtm cancel".
+	RemoveVote(project string, mrIID int, kind, username string) error
+	// ListVoters returns the current voters of the given kind for a merge request.
+	ListVoters(project string, mrIID int, kind string) ([]VoteRecord, error)
+	// ClearVotes removes every LGTM and approve vote for a merge request.
+	ClearVotes(project string, mrIID int) error
+	// SetHold persists or clears the /hold block flag for a merge request.
+	SetHold(project string, mrIID int, held bool) error
+	// GetHold reports whether a merge request currently carries a /hold block.
+	GetHold(project string, mrIID int) (bool, error)
+	// RecordEventUUID reports whether eventUUID was already processed and,
+	// if not, records it so a retried webhook delivery is recognised next time.
+	RecordEventUUID(eventUUID string) (replayed bool, err error)
+}
+
+// store is the active backend, selected in main() by --store.
+var store Store
+
+func newStore() (Store, error) {
+	switch *storeBackend {
+	case "bolt":
+		return newBoltStore(*dbPath)
+	case "redis":
+		if *redisAddr == "" {
+			return nil, errStoreRedisAddrRequired
+		}
+		return newRedisStore(*redisAddr)
+	default:
+		return nil, errStoreUnknownBackend
+	}
+}
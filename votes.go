@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// VoteRecord is a single vote (LGTM or approve) cast by a reviewer, bound to
+// the commit sha that was reviewed so a later push can invalidate it.
+type VoteRecord struct {
+	Username  string    `json:"username"`
+	CommitSHA string    `json:"commit_sha"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// checkLGTMVotes records comment's vote (rejecting self-approval) and
+// reports whether the MR now has LGTM quorum.
+func checkLGTMVotes(comment Comment) (bool, error) {
+	if comment.User.ID != 0 && comment.User.ID == comment.MergeRequest.AuthorID {
+		logrus.WithField("user", comment.User.Username).Warn("rejecting LGTM: MR author can not approve their own merge request")
+		return lgtmQuorumMet(comment)
+	}
+
+	pc := resolveProjectConfig(comment.Project.PathWithNamespace)
+	voters, err := store.IncrementVote(comment.Project.PathWithNamespace, comment.MergeRequest.Iid, voteKindLGTM, comment.User.Username, comment.MergeRequest.LastCommit.ID, pc.DismissStaleReviews)
+	if err != nil {
+		return false, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"count": len(voters),
+		"MR":    comment.MergeRequest.Iid,
+	}).Info("MR voter count")
+
+	required := lgtmCountFor(comment.Project.PathWithNamespace, comment.MergeRequest.TargetBranch)
+	return len(voters) >= required, nil
+}
+
+// checkApproveVotes records comment's /approve vote and reports whether the
+// MR has met its required approver quorum.
+func checkApproveVotes(comment Comment) (bool, error) {
+	if comment.User.ID != 0 && comment.User.ID == comment.MergeRequest.AuthorID {
+		logrus.WithField("user", comment.User.Username).Warn("rejecting /approve: MR author can not approve their own merge request")
+		return approveQuorumMet(comment)
+	}
+
+	pc := resolveProjectConfig(comment.Project.PathWithNamespace)
+	voters, err := store.IncrementVote(comment.Project.PathWithNamespace, comment.MergeRequest.Iid, voteKindApprove, comment.User.Username, comment.MergeRequest.LastCommit.ID, pc.DismissStaleReviews)
+	if err != nil {
+		return false, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"count": len(voters),
+		"MR":    comment.MergeRequest.Iid,
+	}).Info("MR approve count")
+
+	required := approveCountFor(comment.Project.PathWithNamespace)
+	return required == 0 || len(voters) >= required, nil
+}
+
+// lgtmQuorumMet reports whether the MR's persisted LGTM votes already meet
+// quorum, without recording a new vote. dispatchCommands uses this to
+// re-derive quorum state on every comment, not just ones containing /lgtm.
+func lgtmQuorumMet(comment Comment) (bool, error) {
+	voters, err := store.ListVoters(comment.Project.PathWithNamespace, comment.MergeRequest.Iid, voteKindLGTM)
+	if err != nil {
+		return false, err
+	}
+	required := lgtmCountFor(comment.Project.PathWithNamespace, comment.MergeRequest.TargetBranch)
+	return currentVoteCount(comment, voters) >= required, nil
+}
+
+// approveQuorumMet reports whether the MR's persisted /approve votes already
+// meet quorum, without recording a new vote. dispatchCommands uses this to
+// re-derive quorum state on every comment, not just ones containing /approve.
+func approveQuorumMet(comment Comment) (bool, error) {
+	required := approveCountFor(comment.Project.PathWithNamespace)
+	if required == 0 {
+		return true, nil
+	}
+	voters, err := store.ListVoters(comment.Project.PathWithNamespace, comment.MergeRequest.Iid, voteKindApprove)
+	if err != nil {
+		return false, err
+	}
+	return currentVoteCount(comment, voters) >= required, nil
+}
+
+// currentVoteCount counts voters whose vote still applies to comment's
+// current head commit. IncrementVote only purges stale votes as a side
+// effect of a new same-kind vote being cast, so a comment that casts no vote
+// at all (including GitLab's own "added N commits" system notes) must not
+// count a stale vote left over from before a force-push: that would let a
+// force-pushed commit inherit quorum nobody reviewed. When
+// dismiss_stale_reviews is off, every persisted vote still counts regardless
+// of commit sha, matching IncrementVote's own behaviour.
+func currentVoteCount(comment Comment, voters []VoteRecord) int {
+	pc := resolveProjectConfig(comment.Project.PathWithNamespace)
+	if !pc.DismissStaleReviews {
+		return len(voters)
+	}
+	head := comment.MergeRequest.LastCommit.ID
+	count := 0
+	for _, v := range voters {
+		if v.CommitSHA == head {
+			count++
+		}
+	}
+	return count
+}
+
+// statusHandler serves the current LGTM voter list for a merge request as
+// JSON, e.g. for a dashboard: GET /gitlab/status?project=ns/repo&mr=123
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	mrIID, err := strconv.Atoi(r.URL.Query().Get("mr"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid or missing mr query parameter")
+		return
+	}
+	project := r.URL.Query().Get("project")
+
+	voters, err := store.ListVoters(project, mrIID, voteKindLGTM)
+	if err != nil {
+		logrus.WithError(err).Errorln("list voters failed")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(voters)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// fakeStore is a minimal in-memory Store for exercising vote/quorum logic
+// without a real bolt or redis backend.
+type fakeStore struct {
+	voters map[string][]VoteRecord
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{voters: map[string][]VoteRecord{}}
+}
+
+func fakeVoteKey(project string, mrIID int, kind string) string {
+	return fmt.Sprintf("%s#%s#%d", kind, project, mrIID)
+}
+
+func (s *fakeStore) IncrementVote(project string, mrIID int, kind, username, commitSHA string, dismissStale bool) ([]VoteRecord, error) {
+	key := fakeVoteKey(project, mrIID, kind)
+	existing := s.voters[key]
+
+	if dismissStale {
+		for _, v := range existing {
+			if v.CommitSHA != commitSHA {
+				existing = nil
+				break
+			}
+		}
+	}
+
+	updated := make([]VoteRecord, 0, len(existing)+1)
+	found := false
+	for _, v := range existing {
+		if v.Username == username {
+			v.CommitSHA = commitSHA
+			found = true
+		}
+		updated = append(updated, v)
+	}
+	if !found {
+		updated = append(updated, VoteRecord{Username: username, CommitSHA: commitSHA})
+	}
+	s.voters[key] = updated
+	return updated, nil
+}
+
+func (s *fakeStore) RemoveVote(project string, mrIID int, kind, username string) error {
+	key := fakeVoteKey(project, mrIID, kind)
+	var kept []VoteRecord
+	for _, v := range s.voters[key] {
+		if v.Username != username {
+			kept = append(kept, v)
+		}
+	}
+	s.voters[key] = kept
+	return nil
+}
+
+func (s *fakeStore) ListVoters(project string, mrIID int, kind string) ([]VoteRecord, error) {
+	return s.voters[fakeVoteKey(project, mrIID, kind)], nil
+}
+
+func (s *fakeStore) ClearVotes(project string, mrIID int) error {
+	delete(s.voters, fakeVoteKey(project, mrIID, voteKindLGTM))
+	delete(s.voters, fakeVoteKey(project, mrIID, voteKindApprove))
+	return nil
+}
+
+func (s *fakeStore) SetHold(project string, mrIID int, held bool) error { return nil }
+func (s *fakeStore) GetHold(project string, mrIID int) (bool, error)    { return false, nil }
+func (s *fakeStore) RecordEventUUID(eventUUID string) (bool, error)     { return false, nil }
+
+func newLGTMComment(project string, mrIID int, headSHA string) Comment {
+	var c Comment
+	c.Project.PathWithNamespace = project
+	c.MergeRequest.Iid = mrIID
+	c.MergeRequest.LastCommit.ID = headSHA
+	return c
+}
+
+// TestLgtmQuorumMetDismissesStaleVotesOnAnyComment guards against the
+// force-push bypass: two LGTMs land on commit A (quorum met), the author
+// force-pushes commit B, and a later comment that casts no new vote at all
+// (e.g. GitLab's own "added 1 commit" system note) must not see quorum
+// carried over from the stale commit-A votes.
+func TestLgtmQuorumMetDismissesStaleVotesOnAnyComment(t *testing.T) {
+	store = newFakeStore()
+	config = MultiConf{Default: ProjectConfig{LGTMCount: 2, DismissStaleReviews: true}}
+
+	project, mrIID := "ns/repo", 42
+	if _, err := store.IncrementVote(project, mrIID, voteKindLGTM, "alice", "sha-a", true); err != nil {
+		t.Fatalf("seed vote: %v", err)
+	}
+	if _, err := store.IncrementVote(project, mrIID, voteKindLGTM, "bob", "sha-a", true); err != nil {
+		t.Fatalf("seed vote: %v", err)
+	}
+
+	beforePush := newLGTMComment(project, mrIID, "sha-a")
+	met, err := lgtmQuorumMet(beforePush)
+	if err != nil {
+		t.Fatalf("lgtmQuorumMet: %v", err)
+	}
+	if !met {
+		t.Fatal("expected quorum met against the reviewed commit")
+	}
+
+	afterForcePush := newLGTMComment(project, mrIID, "sha-b")
+	met, err = lgtmQuorumMet(afterForcePush)
+	if err != nil {
+		t.Fatalf("lgtmQuorumMet: %v", err)
+	}
+	if met {
+		t.Fatal("quorum must not carry over to a force-pushed commit nobody reviewed")
+	}
+}
+
+func TestLgtmQuorumMetKeepsCountingWhenDismissStaleReviewsDisabled(t *testing.T) {
+	store = newFakeStore()
+	config = MultiConf{Default: ProjectConfig{LGTMCount: 2, DismissStaleReviews: false}}
+
+	project, mrIID := "ns/repo", 7
+	if _, err := store.IncrementVote(project, mrIID, voteKindLGTM, "alice", "sha-a", false); err != nil {
+		t.Fatalf("seed vote: %v", err)
+	}
+	if _, err := store.IncrementVote(project, mrIID, voteKindLGTM, "bob", "sha-a", false); err != nil {
+		t.Fatalf("seed vote: %v", err)
+	}
+
+	met, err := lgtmQuorumMet(newLGTMComment(project, mrIID, "sha-b"))
+	if err != nil {
+		t.Fatalf("lgtmQuorumMet: %v", err)
+	}
+	if !met {
+		t.Fatal("votes must keep counting across pushes when dismiss_stale_reviews is off")
+	}
+}
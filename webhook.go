@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	headerGitlabToken     = "X-Gitlab-Token"
+	headerGitlabEvent     = "X-Gitlab-Event"
+	headerGitlabEventUUID = "X-Gitlab-Event-UUID"
+
+	// NoteHookEvent is the X-Gitlab-Event value for comment webhooks.
+	NoteHookEvent = "Note Hook"
+)
+
+var webhookSecret = flag.String("webhook_secret", "", "shared secret checked against the X-Gitlab-Token header; empty disables verification")
+
+// verifyWebhookToken checks the X-Gitlab-Token header against the configured
+// secret for projectPath (falling back to the global --webhook_secret) using
+// a constant-time comparison. A project with no secret configured anywhere
+// is allowed through, to preserve existing deployments that never set one.
+func verifyWebhookToken(r *http.Request, projectPath string) bool {
+	secret := resolveWebhookSecret(projectPath)
+	if secret == "" {
+		return true
+	}
+	got := r.Header.Get(headerGitlabToken)
+	return subtle.ConstantTimeCompare([]byte(got), []byte(secret)) == 1
+}
+
+func resolveWebhookSecret(projectPath string) string {
+	if secret := resolveProjectConfig(projectPath).WebhookSecret; secret != "" {
+		return secret
+	}
+	return *webhookSecret
+}
+
+// checkReplay reports whether eventUUID has already been processed and
+// records it, so a retried delivery of the same event is rejected instead of
+// double-counting a vote. When replay protection is disabled for the project,
+// or the delivery carries no event UUID, it reports false without checking
+// or recording anything.
+func checkReplay(projectPath, eventUUID string) (bool, error) {
+	if !resolveProjectConfig(projectPath).ReplayProtection || eventUUID == "" {
+		return false, nil
+	}
+
+	return store.RecordEventUUID(eventUUID)
+}
+
+// peekProjectPath decodes just enough of the webhook body to resolve a
+// per-project webhook secret without consuming the body for the real decode.
+func peekProjectPath(body []byte) string {
+	var peek struct {
+		Project struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &peek); err != nil {
+		logrus.WithError(err).Warnln("peek project path failed")
+		return ""
+	}
+	return peek.Project.PathWithNamespace
+}